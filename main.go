@@ -3,35 +3,148 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v2"
 
 	google "golang.org/x/oauth2/google"
-	compute "google.golang.org/api/compute/v1"
 	container "google.golang.org/api/container/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// OutputModeRewrite rewrites the user's PrometheusConfigFile in place,
+	// replacing every kubernetes_sd_configs-bearing scrape config.
+	OutputModeRewrite = "rewrite"
+	// OutputModeFileSD leaves PrometheusConfigFile untouched and instead
+	// writes one file_sd_configs target file per cluster/role plus a
+	// scrape_configs fragment referencing them.
+	OutputModeFileSD = "file_sd"
+)
+
+const (
+	// AuthModeLegacyBasic decodes the cluster's MasterAuth username/password
+	// and client certificate, exactly as this tool has always done.
+	AuthModeLegacyBasic = "legacy_basic"
+	// AuthModeClientCert authenticates with the cluster's client certificate
+	// only, without the deprecated basic_auth block.
+	AuthModeClientCert = "client_cert"
+	// AuthModeGCPToken authenticates with a periodically-refreshed Bearer
+	// token sourced from Workload Identity (in-cluster) or ADC, for clusters
+	// that no longer issue a client certificate.
+	AuthModeGCPToken = "gcp_token"
 )
 
 var (
-	configFile = "/etc/gke-discoverer.yml"
+	configFile   = "/etc/gke-discoverer.yml"
+	logLevelFlag string
 )
 
 func init() {
 	flag.StringVar(&configFile, "config", configFile, "config file to use")
+	flag.StringVar(&logLevelFlag, "log-level", "", "log level: debug, info, warn or error (overrides log_level in the config file)")
+}
+
+// logLevel backs the logger below so LoadConfig can adjust verbosity once
+// it has parsed the config file's log_level (and the -log-level flag, which
+// takes precedence).
+var logLevel = new(slog.LevelVar)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+
+// fatal logs msg at error level and exits non-zero. Reserved for config-file
+// parse errors and missing/invalid credentials - every other failure should
+// be logged and the poll loop left to retry on the next tick.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+const (
+	retryAttempts  = 5
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// withRetry calls fn up to retryAttempts times, with exponential backoff
+// (capped at retryMaxDelay) between attempts, logging each failed attempt.
+// It returns the last error if every attempt fails.
+func withRetry(op string, fields []any, fn func() error) error {
+	delay := retryBaseDelay
+
+	var err error
+	for attempt := 1; attempt <= retryAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		args := append([]any{"op", op, "attempt", attempt, "max_attempts", retryAttempts, "error", err}, fields...)
+		if attempt == retryAttempts {
+			logger.Warn("giving up after repeated failures", args...)
+			break
+		}
+
+		logger.Warn("operation failed, retrying", args...)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+
+	return err
 }
 
 type Config struct {
-	PrometheusConfigFile string `yaml:"prometheus_config"`
-	CertificateStoreDir  string `yaml:"certificate_store"`
-	PrometheusEndpoint   string `yaml:"prometheus_endpoint"`
-	GCPProject           string `yaml:"gcp_project"`
-	PollTime             int64  `yaml:"poll_time"`
+	PrometheusConfigFile string      `yaml:"prometheus_config"`
+	CertificateStoreDir  string      `yaml:"certificate_store"`
+	PrometheusEndpoint   string      `yaml:"prometheus_endpoint"`
+	GCPProject           string      `yaml:"gcp_project"`
+	OutputMode           string      `yaml:"output_mode"`
+	AuthMode             string      `yaml:"auth_mode"`
+	LogLevel             string      `yaml:"log_level"`
+	ListenAddr           string      `yaml:"listen_addr"`
+	GoogleCloud          GoogleCloud `yaml:"google_cloud"`
+
+	// PollTime is the pre-google_cloud-block poll interval in seconds.
+	// Deprecated: set google_cloud.poll_interval instead. Only read when
+	// google_cloud.poll_interval is empty, so existing configs keep working.
+	PollTime int64 `yaml:"poll_time"`
+}
+
+// GoogleCloud holds the knobs that used to be spread across CLI flags and
+// top-level Config fields. It is intentionally permissive: any field left
+// unset falls back to scanning cfg.GCPProject with no filtering, so existing
+// configs keep working untouched.
+type GoogleCloud struct {
+	Projects             []string          `yaml:"projects"`
+	LocationFilter       []string          `yaml:"location_filter"`
+	ClusterLabelSelector map[string]string `yaml:"cluster_label_selector"`
+	PollInterval         string            `yaml:"poll_interval"`
+	CredentialsFile      string            `yaml:"credentials_file"`
+
+	pollInterval time.Duration
+}
+
+// Interval returns the parsed poll interval. LoadConfig must be used to
+// populate it; it is not exported via YAML because yaml.v2 doesn't know how
+// to unmarshal time.Duration directly.
+func (g GoogleCloud) Interval() time.Duration {
+	return g.pollInterval
 }
 
 type PrometheusConfig struct {
@@ -49,6 +162,13 @@ type BasicAuth struct {
 	Password string `yaml:"password"`
 }
 
+// Authorization mirrors Prometheus' generic authorization scrape config
+// stanza, used here for the gcp_token auth mode's Bearer tokens.
+type Authorization struct {
+	Type            string `yaml:"type"`
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
 type KubeSDConfig struct {
 	APIServers []string  `yaml:"api_servers"`
 	Role       string    `yaml:"role"`
@@ -56,24 +176,48 @@ type KubeSDConfig struct {
 	TLSConfig  TLSConfig `yaml:"tls_config,omitempty"`
 }
 
+// FileSDConfig mirrors Prometheus' file_sd_configs scrape config stanza.
+type FileSDConfig struct {
+	Files []string `yaml:"files"`
+}
+
+// FileSDTargetGroup is the JSON document Prometheus' file_sd expects to
+// find in each file referenced by a FileSDConfig.
+type FileSDTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
 type ScrapeConfig struct {
 	JobName             string          `yaml:"job_name"`
+	Scheme              string          `yaml:"scheme,omitempty"`
 	KubernetesSDConfigs []KubeSDConfig  `yaml:"kubernetes_sd_configs,omitempty"`
+	FileSDConfigs       []FileSDConfig  `yaml:"file_sd_configs,omitempty"`
 	RelabelConfigs      []RelabelConfig `yaml:"relabel_configs,omitempty"`
 	BasicAuth           `yaml:"basic_auth,omitempty"`
+	Authorization       *Authorization         `yaml:"authorization,omitempty"`
+	TLSConfig           TLSConfig              `yaml:"tls_config,omitempty"`
 	XXX                 map[string]interface{} `yaml:",inline"`
 }
 
+// FileSDFragment is the file written alongside the per-cluster/role target
+// files in file_sd output mode. It only carries the kube scrape configs -
+// the user is expected to pull it into their own prometheus.yml, e.g. via
+// scrape_config_files.
+type FileSDFragment struct {
+	ScrapeConfigs []ScrapeConfig `yaml:"scrape_configs"`
+}
+
 func LoadConfig(filename string) Config {
 	cfg := Config{}
 	d, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to read config file", "file", filename, "error", err)
 	}
 
 	err = yaml.Unmarshal(d, &cfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to parse config file", "file", filename, "error", err)
 	}
 
 	// Defaults
@@ -89,64 +233,408 @@ func LoadConfig(filename string) Config {
 		cfg.PrometheusEndpoint = "http://localhost:9090"
 	}
 
-	if cfg.PollTime == 0 {
-		cfg.PollTime = 30
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":9099"
+	}
+
+	if len(cfg.GoogleCloud.Projects) == 0 {
+		if cfg.GCPProject == "" {
+			fatal("please supply a GCP project via gcp_project or google_cloud.projects")
+		}
+		cfg.GoogleCloud.Projects = []string{cfg.GCPProject}
+	}
+
+	if cfg.GoogleCloud.PollInterval == "" {
+		if cfg.PollTime != 0 {
+			logger.Warn("poll_time is deprecated, set google_cloud.poll_interval instead", "poll_time", cfg.PollTime)
+			cfg.GoogleCloud.pollInterval = time.Duration(cfg.PollTime) * time.Second
+		} else {
+			cfg.GoogleCloud.pollInterval = 30 * time.Second
+		}
+	} else {
+		d, err := time.ParseDuration(cfg.GoogleCloud.PollInterval)
+		if err != nil {
+			fatal("invalid google_cloud.poll_interval", "value", cfg.GoogleCloud.PollInterval, "error", err)
+		}
+		cfg.GoogleCloud.pollInterval = d
+	}
+
+	if cfg.OutputMode == "" {
+		cfg.OutputMode = OutputModeRewrite
+	}
+	if cfg.OutputMode != OutputModeRewrite && cfg.OutputMode != OutputModeFileSD {
+		fatal("invalid output_mode", "value", cfg.OutputMode, "allowed", []string{OutputModeRewrite, OutputModeFileSD})
+	}
+
+	if cfg.AuthMode == "" {
+		cfg.AuthMode = AuthModeLegacyBasic
+	}
+	switch cfg.AuthMode {
+	case AuthModeLegacyBasic, AuthModeClientCert, AuthModeGCPToken:
+	default:
+		fatal("invalid auth_mode", "value", cfg.AuthMode, "allowed", []string{AuthModeLegacyBasic, AuthModeClientCert, AuthModeGCPToken})
 	}
 
-	if cfg.GCPProject == "" {
-		log.Fatal("Please supply a GCP Project")
+	level := logLevelFlag
+	if level == "" {
+		level = cfg.LogLevel
+	}
+	if level == "" {
+		level = "info"
+	}
+	switch level {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "info":
+		logLevel.Set(slog.LevelInfo)
+	case "warn":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		fatal("invalid log level", "value", level, "allowed", []string{"debug", "info", "warn", "error"})
 	}
+	cfg.LogLevel = level
 
 	return cfg
 }
 
+// resolveAuthMode picks the auth mode for a single cluster: cfg.AuthMode,
+// unless the cluster has no client certificate to offer (the GKE default for
+// clusters created after client-cert issuance was deprecated), in which case
+// it automatically falls back to AuthModeGCPToken.
+func resolveAuthMode(cfg Config, cluster container.Cluster) string {
+	if cluster.MasterAuth == nil || cluster.MasterAuth.ClientCertificate == "" {
+		return AuthModeGCPToken
+	}
+
+	return cfg.AuthMode
+}
+
+// acquireLock takes an exclusive OS-level flock on path, creating it if
+// necessary. It blocks until the lock is available. This guards the
+// cert-store writes and the Prometheus reload against a second discoverer
+// replica running concurrently during a rolling update.
+func acquireLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// releaseLock unlocks and closes a file acquired with acquireLock.
+func releaseLock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// atomicWriteFile writes data to a temp file in the same directory as path,
+// fsyncs it, and renames it into place, so a crash mid-write never leaves a
+// reader (Prometheus, or another discoverer replica) looking at a partial
+// file.
+func atomicWriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".gke-discoverer-tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// writeGCPToken fetches a fresh access token from ts and writes it to path,
+// in the format expected by Prometheus' authorization.credentials_file.
+func writeGCPToken(ts oauth2.TokenSource, path string) error {
+	tok, err := ts.Token()
+	if err != nil {
+		return err
+	}
+
+	return atomicWriteFile(path, []byte(tok.AccessToken), 0600)
+}
+
+// fileSDTargetPath returns the path of the file_sd target file for a given
+// cluster/role, inside the certificate store dir.
+func fileSDTargetPath(storeDir, clusterName, role string) string {
+	return filepath.Join(storeDir, fmt.Sprintf("%v-%v.json", clusterName, role))
+}
+
+// matchesLocationFilter reports whether location (a zone or region name)
+// passes the configured filter. An empty filter matches everything. Entries
+// may use `*` glob patterns, e.g. "us-central1*" for every us-central1 zone
+// and the us-central1 region itself.
+func matchesLocationFilter(location string, filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, pattern := range filter {
+		if ok, err := filepath.Match(pattern, location); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesClusterLabelSelector reports whether a cluster's resource labels
+// contain every key/value pair in selector. An empty selector matches every
+// cluster.
+func matchesClusterLabelSelector(clusterLabels, selector map[string]string) bool {
+	for k, v := range selector {
+		if clusterLabels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// discoveredCluster pairs a GKE cluster with the project it was discovered
+// in. cluster.Name alone does not uniquely identify a cluster once more
+// than one project is being watched, or once zonal and regional clusters
+// of the same name are discovered together (projects/<p>/locations/-
+// returns both), so every place that derives a filesystem path or
+// Prometheus job name from a cluster uses id() instead of Name directly.
+type discoveredCluster struct {
+	container.Cluster
+	Project string
+}
+
+// id returns a filesystem/job-name-safe identifier that is unique across
+// every project and location this discoverer watches.
+func (d discoveredCluster) id() string {
+	return fmt.Sprintf("%v-%v-%v", d.Project, d.Location, d.Name)
+}
+
+// clusterAPIServerEndpoint returns the address Prometheus should scrape the
+// cluster's API server on. Private clusters that have a private endpoint
+// enabled are only reachable on that address; everything else uses the
+// public endpoint.
+func clusterAPIServerEndpoint(cluster container.Cluster) string {
+	pcc := cluster.PrivateClusterConfig
+	if pcc != nil && pcc.EnablePrivateEndpoint && pcc.PrivateEndpoint != "" {
+		return pcc.PrivateEndpoint
+	}
+
+	return cluster.Endpoint
+}
+
+var (
+	pollTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gke_sd_poll_total",
+		Help: "Total number of discovery poll ticks attempted.",
+	})
+	pollErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gke_sd_poll_errors_total",
+		Help: "Total number of poll failures, by stage.",
+	}, []string{"stage"})
+	clustersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gke_sd_clusters",
+		Help: "Number of clusters currently tracked.",
+	})
+	lastSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gke_sd_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last poll that listed clusters and wrote its output.",
+	})
+	reloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "gke_sd_reload_duration_seconds",
+		Help: "Time spent waiting on the Prometheus /-/reload request.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(pollTotal, pollErrorsTotal, clustersGauge, lastSuccessGauge, reloadDuration)
+}
+
+// ClusterInfo is the JSON shape returned by /clusters.
+type ClusterInfo struct {
+	Name     string `json:"name"`
+	Project  string `json:"project"`
+	Endpoint string `json:"endpoint"`
+	Location string `json:"location"`
+}
+
+var (
+	stateMu         sync.RWMutex
+	trackedClusters = []ClusterInfo{}
+	lastSuccessAt   time.Time
+)
+
+// recordSuccess updates the state backing /healthz and /clusters, and the
+// corresponding metrics, after a poll tick has listed clusters and written
+// its output. Failures confined to a single cluster (a token, cert, key or
+// file_sd target write) are counted by recordError but do not prevent it.
+func recordSuccess(clusters []discoveredCluster) {
+	infos := make([]ClusterInfo, 0, len(clusters))
+	for _, c := range clusters {
+		infos = append(infos, ClusterInfo{
+			Name:     c.Name,
+			Project:  c.Project,
+			Endpoint: clusterAPIServerEndpoint(c.Cluster),
+			Location: c.Location,
+		})
+	}
+
+	stateMu.Lock()
+	trackedClusters = infos
+	lastSuccessAt = time.Now()
+	stateMu.Unlock()
+
+	clustersGauge.Set(float64(len(clusters)))
+	lastSuccessGauge.Set(float64(time.Now().Unix()))
+}
+
+// recordError increments the poll error counter for the given stage. stage
+// must be one of "list_clusters", "write_certs" or "reload".
+func recordError(stage string) {
+	pollErrorsTotal.WithLabelValues(stage).Inc()
+}
+
+// serveHTTP starts the /metrics, /healthz and /clusters HTTP server. It
+// blocks while the server runs and only returns, after logging the error,
+// if the listener fails; callers should invoke it in its own goroutine.
+func serveHTTP(cfg Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		stateMu.RLock()
+		last := lastSuccessAt
+		stateMu.RUnlock()
+
+		if last.IsZero() || time.Since(last) > 3*cfg.GoogleCloud.Interval() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "stale: no successful poll recently")
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/clusters", func(w http.ResponseWriter, r *http.Request) {
+		stateMu.RLock()
+		clusters := trackedClusters
+		stateMu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clusters)
+	})
+
+	logger.Error("metrics server stopped", "error", http.ListenAndServe(cfg.ListenAddr, mux))
+}
+
+// writeFileSDTargets writes a single file_sd_configs target file containing
+// the API server endpoint for a cluster/role.
+func writeFileSDTargets(path string, target string, labels map[string]string) error {
+	groups := []FileSDTargetGroup{
+		{
+			Targets: []string{target},
+			Labels:  labels,
+		},
+	}
+
+	d, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicWriteFile(path, d, 0644)
+}
+
 func main() {
 	flag.Parse()
 	cfg := LoadConfig(configFile)
 
+	if cfg.GoogleCloud.CredentialsFile != "" {
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", cfg.GoogleCloud.CredentialsFile)
+	}
+
 	// Create google gubbins.
-	client, err := google.DefaultClient(context.TODO(), container.CloudPlatformScope, compute.ComputeReadonlyScope)
+	client, err := google.DefaultClient(context.TODO(), container.CloudPlatformScope)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to create Google API client", "error", err)
 	}
 
 	containerSvc, err := container.New(client)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to create GKE API client", "error", err)
 	}
 
-	computeSvc, err := compute.New(client)
+	tokenSource, err := google.DefaultTokenSource(context.TODO(), container.CloudPlatformScope)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to create GCP token source", "error", err)
 	}
 
-	oldClusters := []container.Cluster{}
+	go serveHTTP(cfg)
+
+	oldClusters := []discoveredCluster{}
 	hasChanged := false
 
-	ticker := time.NewTicker(time.Duration(cfg.PollTime) * time.Second)
+	ticker := time.NewTicker(cfg.GoogleCloud.Interval())
 
 	for {
 		select {
 		case <-ticker.C:
+			pollTotal.Inc()
 			hasChanged = false
-			res, err := computeSvc.Zones.List(cfg.GCPProject).Do()
-			if err != nil {
-				log.Fatal(err)
-			}
 
-			// Check every zone.
-			newClusterList := []container.Cluster{}
-			for _, z := range res.Items {
-
-				fmt.Println("Zone : ", z.Name)
-				res, err := containerSvc.Projects.Zones.Clusters.List(cfg.GCPProject, z.Name).Do()
+			// Check every location (zonal and regional) in every project.
+			newClusterList := []discoveredCluster{}
+			tickFailed := false
+			for _, project := range cfg.GoogleCloud.Projects {
+				parent := fmt.Sprintf("projects/%v/locations/-", project)
+				var res *container.ListClustersResponse
+				err := withRetry("list_clusters", []any{"project", project}, func() error {
+					var err error
+					res, err = containerSvc.Projects.Locations.Clusters.List(parent).Do()
+					return err
+				})
 				if err != nil {
-					log.Fatal(err)
+					logger.Error("failed to list clusters", "project", project, "error", err)
+					recordError("list_clusters")
+					tickFailed = true
+					break
 				}
+
 				for _, c := range res.Clusters {
-					newClusterList = append(newClusterList, *c)
+					if !matchesLocationFilter(c.Location, cfg.GoogleCloud.LocationFilter) {
+						continue
+					}
+					if !matchesClusterLabelSelector(c.ResourceLabels, cfg.GoogleCloud.ClusterLabelSelector) {
+						continue
+					}
+					logger.Debug("discovered cluster", "cluster", c.Name, "project", project, "location", c.Location)
+					newClusterList = append(newClusterList, discoveredCluster{Cluster: *c, Project: project})
 				}
 			}
+			if tickFailed {
+				break
+			}
 
 			if len(oldClusters) == 0 {
 				oldClusters = newClusterList
@@ -159,7 +647,7 @@ func main() {
 			for _, cluster := range newClusterList {
 				hasFound := false
 				for _, ocluster := range oldClusters {
-					if cluster.Name == ocluster.Name {
+					if cluster.id() == ocluster.id() {
 						hasFound = true
 					}
 				}
@@ -173,7 +661,7 @@ func main() {
 			for i, ocluster := range oldClusters {
 				hasFound := false
 				for _, cluster := range newClusterList {
-					if cluster.Name == ocluster.Name {
+					if cluster.id() == ocluster.id() {
 						hasFound = true
 					}
 				}
@@ -188,93 +676,223 @@ func main() {
 				oldClusters = oldClusters[:i+copy(oldClusters[i:], oldClusters[i+1:])]
 			}
 
-			if !hasChanged {
-				fmt.Println("No Difference in config")
+			lockPath := filepath.Join(cfg.CertificateStoreDir, "gke-discoverer.lock")
+			lock, err := acquireLock(lockPath)
+			if err != nil {
+				logger.Error("failed to acquire cert store lock", "path", lockPath, "error", err)
+				recordError("write_certs")
 				break
 			}
-			fmt.Println("Detected Changed in Config:", len(oldClusters), len(newClusterList))
-			fmt.Println("Old Clusters:")
-			for _, c := range oldClusters {
-				fmt.Println(c.Name)
+
+			// GCP access tokens expire in about an hour, far sooner than
+			// clusters typically come and go, so refresh them every tick
+			// regardless of hasChanged - otherwise a stable cluster set
+			// leaves the token file to go stale after its first write.
+			for _, cluster := range oldClusters {
+				if resolveAuthMode(cfg, cluster.Cluster) != AuthModeGCPToken {
+					continue
+				}
+				TokenFile := fmt.Sprintf("%v/%v-token", cfg.CertificateStoreDir, cluster.id())
+				err := withRetry("write_gcp_token", []any{"cluster", cluster.Name}, func() error {
+					return writeGCPToken(tokenSource, TokenFile)
+				})
+				if err != nil {
+					logger.Error("failed to refresh GCP token", "cluster", cluster.Name, "file", TokenFile, "error", err)
+					recordError("write_certs")
+				}
 			}
-			fmt.Println("New Clusters:")
-			for _, c := range newClusterList {
-				fmt.Println(c.Name)
+
+			if !hasChanged {
+				logger.Debug("no difference in cluster list")
+				releaseLock(lock)
+				recordSuccess(oldClusters)
+				break
 			}
+			logger.Info("cluster list changed", "old_count", len(oldClusters), "new_count", len(newClusterList))
 
 			newScrapeConfigs := []ScrapeConfig{}
 
 			for _, cluster := range oldClusters {
-				CAFile := fmt.Sprintf("%v/%v-ca.pem", cfg.CertificateStoreDir, cluster.Name)
-				CertFile := fmt.Sprintf("%v/%v-cert.pem", cfg.CertificateStoreDir, cluster.Name)
-				KeyFile := fmt.Sprintf("%v/%v-key.pem", cfg.CertificateStoreDir, cluster.Name)
+				CAFile := fmt.Sprintf("%v/%v-ca.pem", cfg.CertificateStoreDir, cluster.id())
+				CertFile := fmt.Sprintf("%v/%v-cert.pem", cfg.CertificateStoreDir, cluster.id())
+				KeyFile := fmt.Sprintf("%v/%v-key.pem", cfg.CertificateStoreDir, cluster.id())
+				TokenFile := fmt.Sprintf("%v/%v-token", cfg.CertificateStoreDir, cluster.id())
 
-				decodedCA, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
-				if err != nil {
-					log.Fatal(err)
+				authMode := resolveAuthMode(cfg, cluster.Cluster)
+
+				if cluster.MasterAuth == nil {
+					logger.Error("cluster has no MasterAuth, skipping", "cluster", cluster.Name)
+					recordError("write_certs")
+					continue
 				}
-				decodedCert, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClientCertificate)
+
+				decodedCA, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
 				if err != nil {
-					log.Fatal(err)
+					logger.Error("failed to decode cluster CA certificate", "cluster", cluster.Name, "error", err)
+					recordError("write_certs")
+					continue
 				}
-				decodedKey, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClientKey)
+				err = withRetry("write_ca_file", []any{"cluster", cluster.Name}, func() error {
+					return atomicWriteFile(CAFile, decodedCA, 0644)
+				})
 				if err != nil {
-					log.Fatal(err)
+					logger.Error("failed to write CA file", "cluster", cluster.Name, "file", CAFile, "error", err)
+					recordError("write_certs")
+					continue
 				}
 
-				err = ioutil.WriteFile(CAFile, decodedCA, 0644)
-				if err != nil {
-					log.Fatal(err)
-				}
+				writeErr := error(nil)
+				if authMode == AuthModeGCPToken {
+					// Token file is refreshed independently of cluster-set
+					// changes above; nothing left to write here.
+				} else {
+					decodedCert, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClientCertificate)
+					if err != nil {
+						logger.Error("failed to decode cluster client certificate", "cluster", cluster.Name, "error", err)
+						recordError("write_certs")
+						continue
+					}
+					decodedKey, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClientKey)
+					if err != nil {
+						logger.Error("failed to decode cluster client key", "cluster", cluster.Name, "error", err)
+						recordError("write_certs")
+						continue
+					}
 
-				err = ioutil.WriteFile(CertFile, decodedCert, 0644)
-				if err != nil {
-					log.Fatal(err)
+					writeErr = withRetry("write_cert_file", []any{"cluster", cluster.Name}, func() error {
+						return atomicWriteFile(CertFile, decodedCert, 0644)
+					})
+					if writeErr == nil {
+						writeErr = withRetry("write_key_file", []any{"cluster", cluster.Name}, func() error {
+							return atomicWriteFile(KeyFile, decodedKey, 0644)
+						})
+					}
+					if writeErr != nil {
+						logger.Error("failed to write client cert/key", "cluster", cluster.Name, "error", writeErr)
+						recordError("write_certs")
+					}
+				}
+				if writeErr != nil {
+					continue
 				}
 
-				err = ioutil.WriteFile(KeyFile, decodedKey, 0644)
-				if err != nil {
-					log.Fatal(err)
+				apiServerHost := clusterAPIServerEndpoint(cluster.Cluster)
+				apiServer := "https://" + apiServerHost
+
+				tlsConfig := TLSConfig{CAFile: CAFile}
+				if authMode != AuthModeGCPToken {
+					tlsConfig.CertFile = CertFile
+					tlsConfig.KeyFile = KeyFile
 				}
 
 				for r, c := range GetRoles() {
 					scc := ScrapeConfig{
-						JobName: fmt.Sprintf("kubernetes_%v_%v", cluster.Name, r),
-						BasicAuth: BasicAuth{
+						JobName: fmt.Sprintf("kubernetes_%v_%v", cluster.id(), r),
+						RelabelConfigs: append(c, RelabelConfig{
+							TargetLabel: "location",
+							Replacement: cluster.Location,
+						}),
+					}
+
+					switch authMode {
+					case AuthModeLegacyBasic:
+						scc.BasicAuth = BasicAuth{
 							Username: cluster.MasterAuth.Username,
 							Password: cluster.MasterAuth.Password,
-						},
-						KubernetesSDConfigs: []KubeSDConfig{
-							KubeSDConfig{
+						}
+					case AuthModeGCPToken:
+						scc.Authorization = &Authorization{
+							Type:            "Bearer",
+							CredentialsFile: TokenFile,
+						}
+					}
+
+					if cfg.OutputMode == OutputModeFileSD {
+						// file_sd targets are bare host[:port] - Prometheus
+						// rejects a target carrying a URL scheme - so the
+						// scrape's scheme and the API server's CA (and,
+						// where applicable, client cert) travel on the
+						// scrape config itself instead of the target.
+						scc.Scheme = "https"
+						scc.TLSConfig = tlsConfig
+
+						targetFile := fileSDTargetPath(cfg.CertificateStoreDir, cluster.id(), r)
+						err := withRetry("write_file_sd_targets", []any{"cluster", cluster.Name, "role", r}, func() error {
+							return writeFileSDTargets(targetFile, apiServerHost, map[string]string{
+								"cluster":  cluster.Name,
+								"role":     r,
+								"location": cluster.Location,
+							})
+						})
+						if err != nil {
+							logger.Error("failed to write file_sd targets", "cluster", cluster.Name, "role", r, "file", targetFile, "error", err)
+							recordError("write_certs")
+							continue
+						}
+
+						scc.FileSDConfigs = []FileSDConfig{
+							{Files: []string{targetFile}},
+						}
+					} else {
+						scc.KubernetesSDConfigs = []KubeSDConfig{
+							{
 								APIServers: []string{
-									"https://" + cluster.Endpoint,
+									apiServer,
 								},
 								Role:      r,
 								InCluster: false,
-								TLSConfig: TLSConfig{
-									CAFile:   CAFile,
-									CertFile: CertFile,
-									KeyFile:  KeyFile,
-								},
+								TLSConfig: tlsConfig,
 							},
-						},
-						RelabelConfigs: c,
+						}
 					}
 
 					newScrapeConfigs = append(newScrapeConfigs, scc)
 				}
 			}
 
+			if cfg.OutputMode == OutputModeFileSD {
+				fragment := FileSDFragment{ScrapeConfigs: newScrapeConfigs}
+				d, err := yaml.Marshal(&fragment)
+				if err != nil {
+					logger.Error("failed to marshal file_sd fragment", "error", err)
+					recordError("write_certs")
+					releaseLock(lock)
+					break
+				}
+
+				fragmentFile := filepath.Join(cfg.CertificateStoreDir, "scrape_configs.yml")
+				err = withRetry("write_file_sd_fragment", nil, func() error {
+					return atomicWriteFile(fragmentFile, d, 0644)
+				})
+				if err != nil {
+					logger.Error("failed to write file_sd fragment", "file", fragmentFile, "error", err)
+					recordError("write_certs")
+					releaseLock(lock)
+					break
+				}
+
+				logger.Info("wrote file_sd fragment", "file", fragmentFile)
+				releaseLock(lock)
+				recordSuccess(oldClusters)
+				break
+			}
+
 			cfgp := PrometheusConfig{}
 
-			d, err := ioutil.ReadFile(cfg.PrometheusConfigFile)
+			origYAML, err := ioutil.ReadFile(cfg.PrometheusConfigFile)
 			if err != nil {
-				log.Fatal(err)
+				logger.Error("failed to read Prometheus config", "file", cfg.PrometheusConfigFile, "error", err)
+				recordError("write_certs")
+				releaseLock(lock)
+				break
 			}
 
-			err = yaml.Unmarshal(d, &cfgp)
+			err = yaml.Unmarshal(origYAML, &cfgp)
 			if err != nil {
-				log.Fatal(err)
+				logger.Error("failed to parse Prometheus config", "file", cfg.PrometheusConfigFile, "error", err)
+				recordError("write_certs")
+				releaseLock(lock)
+				break
 			}
 
 			for _, sc := range cfgp.ScrapeConfigs {
@@ -286,22 +904,54 @@ func main() {
 
 			cfgp.ScrapeConfigs = newScrapeConfigs
 
-			d, err = yaml.Marshal(&cfgp)
+			newYAML, err := yaml.Marshal(&cfgp)
 			if err != nil {
-				log.Fatal(err)
+				logger.Error("failed to marshal Prometheus config", "error", err)
+				recordError("write_certs")
+				releaseLock(lock)
+				break
+			}
+
+			if bytes.Equal(newYAML, origYAML) {
+				logger.Debug("no change in Prometheus config, skipping reload")
+				releaseLock(lock)
+				recordSuccess(oldClusters)
+				break
 			}
 
-			err = ioutil.WriteFile(cfg.PrometheusConfigFile, d, 0644)
+			err = withRetry("write_prometheus_config", nil, func() error {
+				return atomicWriteFile(cfg.PrometheusConfigFile, newYAML, 0644)
+			})
 			if err != nil {
-				log.Fatal(err)
+				logger.Error("failed to write Prometheus config", "file", cfg.PrometheusConfigFile, "error", err)
+				recordError("write_certs")
+				releaseLock(lock)
+				break
 			}
 
-			fmt.Println("Reloading Prometheus Config")
+			logger.Info("reloading Prometheus config")
 			// Reload Prometheus Config
-			_, err = http.Post(cfg.PrometheusEndpoint+"/-/reload", "text/plain", bytes.NewBufferString(""))
+			reloadStart := time.Now()
+			err = withRetry("reload_prometheus", nil, func() error {
+				resp, err := http.Post(cfg.PrometheusEndpoint+"/-/reload", "text/plain", bytes.NewBufferString(""))
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					return fmt.Errorf("prometheus reload returned status %v", resp.Status)
+				}
+				return nil
+			})
+			reloadDuration.Observe(time.Since(reloadStart).Seconds())
 			if err != nil {
-				log.Fatal(err)
+				logger.Error("failed to reload Prometheus", "endpoint", cfg.PrometheusEndpoint, "error", err)
+				recordError("reload")
+			} else {
+				recordSuccess(oldClusters)
 			}
+
+			releaseLock(lock)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	container "google.golang.org/api/container/v1"
+)
+
+func writeTempConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gke-discoverer.yml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := writeTempConfig(t, "gcp_project: my-project\n")
+
+	cfg := LoadConfig(path)
+
+	if cfg.OutputMode != OutputModeRewrite {
+		t.Errorf("OutputMode = %q, want %q", cfg.OutputMode, OutputModeRewrite)
+	}
+	if cfg.AuthMode != AuthModeLegacyBasic {
+		t.Errorf("AuthMode = %q, want %q", cfg.AuthMode, AuthModeLegacyBasic)
+	}
+	if cfg.ListenAddr != ":9099" {
+		t.Errorf("ListenAddr = %q, want %q", cfg.ListenAddr, ":9099")
+	}
+	if got, want := cfg.GoogleCloud.Interval(), 30*time.Second; got != want {
+		t.Errorf("Interval() = %v, want %v", got, want)
+	}
+	if len(cfg.GoogleCloud.Projects) != 1 || cfg.GoogleCloud.Projects[0] != "my-project" {
+		t.Errorf("Projects = %v, want [my-project]", cfg.GoogleCloud.Projects)
+	}
+}
+
+func TestLoadConfigOutputAndAuthMode(t *testing.T) {
+	path := writeTempConfig(t, "gcp_project: my-project\noutput_mode: file_sd\nauth_mode: gcp_token\n")
+
+	cfg := LoadConfig(path)
+
+	if cfg.OutputMode != OutputModeFileSD {
+		t.Errorf("OutputMode = %q, want %q", cfg.OutputMode, OutputModeFileSD)
+	}
+	if cfg.AuthMode != AuthModeGCPToken {
+		t.Errorf("AuthMode = %q, want %q", cfg.AuthMode, AuthModeGCPToken)
+	}
+}
+
+func TestLoadConfigPollInterval(t *testing.T) {
+	path := writeTempConfig(t, "gcp_project: my-project\ngoogle_cloud:\n  poll_interval: 90s\n")
+
+	cfg := LoadConfig(path)
+
+	if got, want := cfg.GoogleCloud.Interval(), 90*time.Second; got != want {
+		t.Errorf("Interval() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigPollTimeAlias(t *testing.T) {
+	path := writeTempConfig(t, "gcp_project: my-project\npoll_time: 45\n")
+
+	cfg := LoadConfig(path)
+
+	if got, want := cfg.GoogleCloud.Interval(), 45*time.Second; got != want {
+		t.Errorf("Interval() = %v, want %v (poll_time alias)", got, want)
+	}
+}
+
+func TestLoadConfigPollIntervalOverridesPollTime(t *testing.T) {
+	path := writeTempConfig(t, "gcp_project: my-project\npoll_time: 45\ngoogle_cloud:\n  poll_interval: 10s\n")
+
+	cfg := LoadConfig(path)
+
+	if got, want := cfg.GoogleCloud.Interval(), 10*time.Second; got != want {
+		t.Errorf("Interval() = %v, want %v (poll_interval should win)", got, want)
+	}
+}
+
+func TestLoadConfigLogLevel(t *testing.T) {
+	path := writeTempConfig(t, "gcp_project: my-project\nlog_level: debug\n")
+
+	cfg := LoadConfig(path)
+
+	if cfg.LogLevel != "debug" {
+		t.Errorf("LogLevel = %q, want %q", cfg.LogLevel, "debug")
+	}
+}
+
+func TestMatchesLocationFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		filter   []string
+		want     bool
+	}{
+		{"empty filter matches everything", "us-central1-a", nil, true},
+		{"exact zone match", "us-central1-a", []string{"us-central1-a"}, true},
+		{"zone glob match", "us-central1-a", []string{"us-central1*"}, true},
+		{"region glob matches region itself", "us-central1", []string{"us-central1*"}, true},
+		{"no match", "europe-west1-b", []string{"us-central1*"}, false},
+		{"match among several patterns", "europe-west1-b", []string{"us-central1*", "europe-west1*"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesLocationFilter(tt.location, tt.filter); got != tt.want {
+				t.Errorf("matchesLocationFilter(%q, %v) = %v, want %v", tt.location, tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesClusterLabelSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		selector map[string]string
+		want     bool
+	}{
+		{"empty selector matches everything", map[string]string{"env": "prod"}, nil, true},
+		{"matching single key", map[string]string{"env": "prod"}, map[string]string{"env": "prod"}, true},
+		{"mismatched value", map[string]string{"env": "staging"}, map[string]string{"env": "prod"}, false},
+		{"missing key", map[string]string{"team": "sre"}, map[string]string{"env": "prod"}, false},
+		{"all keys must match", map[string]string{"env": "prod", "team": "sre"}, map[string]string{"env": "prod", "team": "infra"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesClusterLabelSelector(tt.labels, tt.selector); got != tt.want {
+				t.Errorf("matchesClusterLabelSelector(%v, %v) = %v, want %v", tt.labels, tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAuthMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		cluster container.Cluster
+		want    string
+	}{
+		{
+			name:    "legacy basic cluster with client cert uses configured mode",
+			cfg:     Config{AuthMode: AuthModeLegacyBasic},
+			cluster: container.Cluster{MasterAuth: &container.MasterAuth{ClientCertificate: "cert"}},
+			want:    AuthModeLegacyBasic,
+		},
+		{
+			name:    "client_cert cluster with client cert uses configured mode",
+			cfg:     Config{AuthMode: AuthModeClientCert},
+			cluster: container.Cluster{MasterAuth: &container.MasterAuth{ClientCertificate: "cert"}},
+			want:    AuthModeClientCert,
+		},
+		{
+			name:    "no client certificate falls back to gcp_token",
+			cfg:     Config{AuthMode: AuthModeLegacyBasic},
+			cluster: container.Cluster{MasterAuth: &container.MasterAuth{ClientCertificate: ""}},
+			want:    AuthModeGCPToken,
+		},
+		{
+			name:    "nil MasterAuth falls back to gcp_token",
+			cfg:     Config{AuthMode: AuthModeLegacyBasic},
+			cluster: container.Cluster{MasterAuth: nil},
+			want:    AuthModeGCPToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveAuthMode(tt.cfg, tt.cluster); got != tt.want {
+				t.Errorf("resolveAuthMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveredClusterID(t *testing.T) {
+	a := discoveredCluster{Cluster: container.Cluster{Name: "prod", Location: "us-central1-a"}, Project: "proj-a"}
+	b := discoveredCluster{Cluster: container.Cluster{Name: "prod", Location: "us-central1"}, Project: "proj-a"}
+	c := discoveredCluster{Cluster: container.Cluster{Name: "prod", Location: "us-central1-a"}, Project: "proj-b"}
+
+	if a.id() == b.id() {
+		t.Errorf("zonal and regional clusters with the same name collided: %q", a.id())
+	}
+	if a.id() == c.id() {
+		t.Errorf("clusters from different projects collided: %q", a.id())
+	}
+}